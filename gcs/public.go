@@ -7,6 +7,9 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
 
 	"cloud.google.com/go/storage"
 	"github.com/aptly-dev/aptly/aptly"
@@ -15,12 +18,25 @@ import (
 	"google.golang.org/api/iterator"
 )
 
+// defaultConcurrency is used when NewPublishedStorage is given a
+// non-positive concurrency value
+const defaultConcurrency = 10
+
 // PublishedStorage abstract file system with published files (actually hosted on GCS)
 type PublishedStorage struct {
-	gcs        *storage.Client
-	bucketName string
-	prefix     string
-	pathCache  map[string]string
+	gcs         *storage.Client
+	bucketName  string
+	prefix      string
+	concurrency int
+	pathCacheMu sync.RWMutex
+	pathCache   map[string]string
+
+	storageClass                string
+	kmsKeyName                  string
+	indexCacheControl           string
+	poolCacheControl            string
+	predefinedACL               string
+	forceOverwritePreconditions bool
 }
 
 // Check interface
@@ -28,14 +44,53 @@ var (
 	_ aptly.PublishedStorage = (*PublishedStorage)(nil)
 )
 
-// NewPublishedStorage creates published storage from raw gcp credentials
-func NewPublishedStorage(bucketName string, prefix string) (*PublishedStorage, error) {
+// ObjectConfig groups the per-object tuning knobs accepted by
+// NewPublishedStorage, so values such as IndexCacheControl and
+// PoolCacheControl are passed by field name rather than as a run of
+// positional string arguments.
+//
+// StorageClass, KMSKeyName and PredefinedACL are applied to every object
+// written through the storage; leave them empty to use the bucket's
+// defaults. IndexCacheControl is applied to dists/* index files and
+// PoolCacheControl to pool/* package files. ForceOverwritePreconditions
+// is documented on object(), which is where it's enforced.
+type ObjectConfig struct {
+	StorageClass                string
+	KMSKeyName                  string
+	IndexCacheControl           string
+	PoolCacheControl            string
+	PredefinedACL               string
+	ForceOverwritePreconditions bool
+}
+
+// NewPublishedStorage creates published storage from raw gcp credentials.
+//
+// concurrency controls how many pool files PublishBatch will upload at
+// once; a non-positive value falls back to defaultConcurrency. cfg holds
+// the per-object tuning knobs; see ObjectConfig.
+func NewPublishedStorage(bucketName string, prefix string, concurrency int, cfg ObjectConfig) (*PublishedStorage, error) {
 	gcs, err := storage.NewClient(context.Background())
 	if err != nil {
 		return nil, fmt.Errorf("Unable to create storage service: %v", err)
 	}
 
-	return &PublishedStorage{gcs, bucketName, prefix, nil}, nil
+	if concurrency <= 0 {
+		concurrency = defaultConcurrency
+	}
+
+	return &PublishedStorage{
+		gcs:         gcs,
+		bucketName:  bucketName,
+		prefix:      prefix,
+		concurrency: concurrency,
+
+		storageClass:                cfg.StorageClass,
+		kmsKeyName:                  cfg.KMSKeyName,
+		indexCacheControl:           cfg.IndexCacheControl,
+		poolCacheControl:            cfg.PoolCacheControl,
+		predefinedACL:               cfg.PredefinedACL,
+		forceOverwritePreconditions: cfg.ForceOverwritePreconditions,
+	}, nil
 }
 
 func (publishedStorage *PublishedStorage) String() string {
@@ -65,10 +120,17 @@ func (publishedStorage *PublishedStorage) PutFile(path string, sourceFilename st
 }
 
 func (publishedStorage *PublishedStorage) putFile(path string, source io.ReadSeeker) error {
-	ctx := context.Background()
+	return publishedStorage.putFileContext(context.Background(), path, source)
+}
+
+func (publishedStorage *PublishedStorage) putFileContext(ctx context.Context, path string, source io.ReadSeeker) error {
 	key := filepath.Join(publishedStorage.prefix, path)
 
-	wc := publishedStorage.gcs.Bucket(publishedStorage.bucketName).Object(key).NewWriter(ctx)
+	o := publishedStorage.object(ctx, key)
+
+	wc := o.NewWriter(ctx)
+	publishedStorage.configureWriter(wc, path)
+
 	if _, err := io.Copy(wc, source); err != nil {
 		return err
 	}
@@ -79,6 +141,86 @@ func (publishedStorage *PublishedStorage) putFile(path string, source io.ReadSee
 	return nil
 }
 
+// object returns the object handle to write key through. By default this
+// is a plain, unconditional write, matching the storage's historical
+// behavior. When forceOverwritePreconditions is set, the write is guarded
+// with a DoesNotExist precondition on first write or a generation-match
+// precondition on overwrite, so two aptly processes racing to publish the
+// same object fail instead of silently clobbering each other; opting into
+// this costs an extra Attrs GET per object, so it is off unless requested.
+//
+// Known limitation: if that Attrs call fails for a reason other than
+// ErrObjectNotExist (a transient network error, a permissions issue),
+// the guard is silently dropped and the write goes out unconditionally.
+func (publishedStorage *PublishedStorage) object(ctx context.Context, key string) *storage.ObjectHandle {
+	o := publishedStorage.gcs.Bucket(publishedStorage.bucketName).Object(key)
+	if !publishedStorage.forceOverwritePreconditions {
+		return o
+	}
+
+	attrs, err := o.Attrs(ctx)
+	switch err {
+	case nil:
+		return o.If(storage.Conditions{GenerationMatch: attrs.Generation})
+	case storage.ErrObjectNotExist:
+		return o.If(storage.Conditions{DoesNotExist: true})
+	default:
+		// unable to determine current state, fall back to an unconditional write
+		return o
+	}
+}
+
+// configureWriter applies the configured storage class, KMS key, ACL and
+// (index vs pool) cache-control to a freshly created object writer
+func (publishedStorage *PublishedStorage) configureWriter(wc *storage.Writer, path string) {
+	if publishedStorage.storageClass != "" {
+		wc.StorageClass = publishedStorage.storageClass
+	}
+	if publishedStorage.kmsKeyName != "" {
+		wc.KMSKeyName = publishedStorage.kmsKeyName
+	}
+	if cacheControl := publishedStorage.cacheControlFor(path); cacheControl != "" {
+		wc.CacheControl = cacheControl
+	}
+	if publishedStorage.predefinedACL != "" {
+		wc.PredefinedACL = publishedStorage.predefinedACL
+	}
+}
+
+// configureCopier applies the same object settings as configureWriter to a
+// Copier, used by RenameFile and copy
+func (publishedStorage *PublishedStorage) configureCopier(copier *storage.Copier, path string) {
+	if publishedStorage.storageClass != "" {
+		copier.StorageClass = publishedStorage.storageClass
+	}
+	if publishedStorage.kmsKeyName != "" {
+		copier.DestinationKMSKeyName = publishedStorage.kmsKeyName
+	}
+	if cacheControl := publishedStorage.cacheControlFor(path); cacheControl != "" {
+		copier.CacheControl = cacheControl
+	}
+	if publishedStorage.predefinedACL != "" {
+		copier.PredefinedACL = publishedStorage.predefinedACL
+	}
+}
+
+// cacheControlFor returns the configured cache-control for path, treating
+// pool/* package files as long-lived/immutable and everything else (dist
+// indexes) as short-lived
+func (publishedStorage *PublishedStorage) cacheControlFor(path string) string {
+	if isPoolPath(path) {
+		return publishedStorage.poolCacheControl
+	}
+	return publishedStorage.indexCacheControl
+}
+
+// isPoolPath returns true if path (relative to the storage prefix) lives
+// under pool/, as opposed to a dist index file
+func isPoolPath(path string) bool {
+	path = strings.TrimPrefix(path, "/")
+	return path == "pool" || strings.HasPrefix(path, "pool/")
+}
+
 // Remove removes single file under public path
 func (publishedStorage *PublishedStorage) Remove(path string) error {
 	ctx := context.Background()
@@ -97,7 +239,30 @@ func (publishedStorage *PublishedStorage) Remove(path string) error {
 }
 
 // RemoveDirs removes directory structure under public path
+//
+// path may be a plain directory prefix or a glob pattern (e.g.
+// pool/main/*/lib*/*_1.0*.deb), in which case only the matching objects
+// are removed instead of the whole prefix
 func (publishedStorage *PublishedStorage) RemoveDirs(path string, progress aptly.Progress) error {
+	if isWildcard(path) {
+		filelist, err := publishedStorage.FilelistWildcard(path)
+		if err != nil {
+			if err == storage.ErrBucketNotExist {
+				// ignore 'no such bucket' errors on removal
+				return nil
+			}
+			return err
+		}
+
+		for i := range filelist {
+			err := publishedStorage.Remove(filelist[i])
+			if err != nil {
+				return fmt.Errorf("error deleting path %s from %s: %s", filelist[i], publishedStorage, err)
+			}
+		}
+		return nil
+	}
+
 	filelist, _, err := publishedStorage.internalFilelist(path)
 	if err != nil {
 		if err == storage.ErrBucketNotExist {
@@ -124,24 +289,20 @@ func (publishedStorage *PublishedStorage) RemoveDirs(path string, progress aptly
 //
 // LinkFromPool returns relative path for the published file to be included in package index
 func (publishedStorage *PublishedStorage) LinkFromPool(publishedDirectory, fileName string, sourcePool aptly.PackagePool,
+	sourcePath string, sourceChecksums utils.ChecksumInfo, force bool) error {
+	return publishedStorage.linkFromPool(context.Background(), publishedDirectory, fileName, sourcePool, sourcePath, sourceChecksums, force)
+}
+
+func (publishedStorage *PublishedStorage) linkFromPool(ctx context.Context, publishedDirectory, fileName string, sourcePool aptly.PackagePool,
 	sourcePath string, sourceChecksums utils.ChecksumInfo, force bool) error {
 	relPath := filepath.Join(publishedDirectory, fileName)
 	poolPath := filepath.Join(publishedStorage.prefix, relPath)
 
-	if publishedStorage.pathCache == nil {
-		paths, md5s, err := publishedStorage.internalFilelist("")
-		if err != nil {
-			return errors.Wrap(err, "error caching paths under prefix")
-		}
-
-		publishedStorage.pathCache = make(map[string]string, len(paths))
-
-		for i := range paths {
-			publishedStorage.pathCache[paths[i]] = md5s[i]
-		}
+	if err := publishedStorage.ensurePathCache(); err != nil {
+		return errors.Wrap(err, "error caching paths under prefix")
 	}
 
-	destinationMD5, exists := publishedStorage.pathCache[relPath]
+	destinationMD5, exists := publishedStorage.cachedMD5(relPath)
 	sourceMD5 := sourceChecksums.MD5
 
 	if exists {
@@ -165,9 +326,9 @@ func (publishedStorage *PublishedStorage) LinkFromPool(publishedDirectory, fileN
 	}
 	defer source.Close()
 
-	err = publishedStorage.putFile(relPath, source)
+	err = publishedStorage.putFileContext(ctx, relPath, source)
 	if err == nil {
-		publishedStorage.pathCache[relPath] = sourceMD5
+		publishedStorage.setCachedMD5(relPath, sourceMD5)
 	} else {
 		err = errors.Wrap(err, fmt.Sprintf("error uploading %s to %s: %s", sourcePath, publishedStorage, poolPath))
 	}
@@ -175,6 +336,129 @@ func (publishedStorage *PublishedStorage) LinkFromPool(publishedDirectory, fileN
 	return err
 }
 
+// ensurePathCache populates pathCache, if it hasn't been populated yet, by
+// listing every object currently published under the storage prefix
+func (publishedStorage *PublishedStorage) ensurePathCache() error {
+	publishedStorage.pathCacheMu.RLock()
+	primed := publishedStorage.pathCache != nil
+	publishedStorage.pathCacheMu.RUnlock()
+	if primed {
+		return nil
+	}
+
+	publishedStorage.pathCacheMu.Lock()
+	defer publishedStorage.pathCacheMu.Unlock()
+	if publishedStorage.pathCache != nil {
+		return nil
+	}
+
+	paths, md5s, err := publishedStorage.internalFilelist("")
+	if err != nil {
+		return err
+	}
+
+	pathCache := make(map[string]string, len(paths))
+	for i := range paths {
+		pathCache[paths[i]] = md5s[i]
+	}
+	publishedStorage.pathCache = pathCache
+
+	return nil
+}
+
+func (publishedStorage *PublishedStorage) cachedMD5(relPath string) (string, bool) {
+	publishedStorage.pathCacheMu.RLock()
+	defer publishedStorage.pathCacheMu.RUnlock()
+
+	md5, exists := publishedStorage.pathCache[relPath]
+	return md5, exists
+}
+
+func (publishedStorage *PublishedStorage) setCachedMD5(relPath, md5 string) {
+	publishedStorage.pathCacheMu.Lock()
+	defer publishedStorage.pathCacheMu.Unlock()
+
+	publishedStorage.pathCache[relPath] = md5
+}
+
+// PoolEntry describes a single package pool file to be linked into the
+// published tree as part of a PublishBatch call
+type PoolEntry struct {
+	PublishedDirectory string
+	FileName           string
+	SourcePath         string
+	SourceChecksums    utils.ChecksumInfo
+}
+
+// PublishBatch links a batch of package pool files into the published tree
+// concurrently, using up to publishedStorage.concurrency workers. All
+// entries are read from sourcePool using the same force flag as
+// LinkFromPool. If any entry fails, the remaining queued entries are
+// cancelled via ctx and the errors are aggregated into a single error.
+func (publishedStorage *PublishedStorage) PublishBatch(ctx context.Context, sourcePool aptly.PackagePool, entries []PoolEntry, force bool) error {
+	if err := publishedStorage.ensurePathCache(); err != nil {
+		return errors.Wrap(err, "error caching paths under prefix")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	concurrency := publishedStorage.concurrency
+	if concurrency <= 0 {
+		concurrency = defaultConcurrency
+	}
+	sem := make(chan struct{}, concurrency)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []error
+
+	for _, entry := range entries {
+		entry := entry
+
+		select {
+		case <-ctx.Done():
+		case sem <- struct{}{}:
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			if err := publishedStorage.linkFromPool(ctx, entry.PublishedDirectory, entry.FileName, sourcePool, entry.SourcePath, entry.SourceChecksums, force); err != nil {
+				mu.Lock()
+				errs = append(errs, errors.Wrapf(err, "error publishing %s", entry.FileName))
+				mu.Unlock()
+				cancel()
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	return aggregateErrors(errs)
+}
+
+func aggregateErrors(errs []error) error {
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	default:
+		messages := make([]string, len(errs))
+		for i, err := range errs {
+			messages[i] = err.Error()
+		}
+		return fmt.Errorf("%d errors publishing batch: %s", len(errs), strings.Join(messages, "; "))
+	}
+}
+
 func (publishedStorage *PublishedStorage) attrs(path string) (*storage.ObjectAttrs, error) {
 	ctx := context.Background()
 
@@ -225,6 +509,113 @@ func (publishedStorage *PublishedStorage) internalFilelist(prefix string) (paths
 	return paths, md5s, nil
 }
 
+// FilelistWildcard returns list of files matching a glob pattern (e.g.
+// dists/*/main/binary-*/Packages*) rather than a plain prefix.
+//
+// `**` matches across directory separators, while a single `*` does not,
+// matching the convention used elsewhere for pool/dist patterns.
+func (publishedStorage *PublishedStorage) FilelistWildcard(pattern string) ([]string, error) {
+	paths, _, err := publishedStorage.internalFilelistWildcard(pattern)
+	return paths, err
+}
+
+func (publishedStorage *PublishedStorage) internalFilelistWildcard(pattern string) (paths []string, md5s []string, err error) {
+	ctx := context.Background()
+
+	paths = make([]string, 0, 1024)
+	md5s = make([]string, 0, 1024)
+
+	fullPattern := filepath.Join(publishedStorage.prefix, pattern)
+
+	re, err := wildcardToRegexp(fullPattern)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "error parsing wildcard pattern %s", pattern)
+	}
+
+	basePrefix := publishedStorage.prefix
+	if basePrefix != "" {
+		basePrefix += "/"
+	}
+
+	it := publishedStorage.gcs.Bucket(publishedStorage.bucketName).Objects(ctx, &storage.Query{
+		Prefix: wildcardLiteralPrefix(fullPattern),
+	})
+
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, nil, errors.WithMessagef(err, "error listing under prefix %s in %s: %s", fullPattern, publishedStorage, err)
+		}
+		if !re.MatchString(attrs.Name) {
+			continue
+		}
+		name := attrs.Name
+		if basePrefix != "" {
+			name = strings.TrimPrefix(name, basePrefix)
+		}
+		paths = append(paths, name)
+		md5s = append(md5s, hex.EncodeToString(attrs.MD5))
+	}
+	return paths, md5s, nil
+}
+
+// isWildcard returns true if path contains any glob meta characters
+func isWildcard(path string) bool {
+	return strings.ContainsAny(path, "*?[")
+}
+
+// wildcardLiteralPrefix returns the longest literal (non-glob) prefix of
+// pattern, up to the first wildcard meta character, so it can be used as
+// a GCS Query.Prefix to scan a single page range instead of the whole bucket.
+func wildcardLiteralPrefix(pattern string) string {
+	if idx := strings.IndexAny(pattern, "*?["); idx >= 0 {
+		return pattern[:idx]
+	}
+	return pattern
+}
+
+// wildcardToRegexp translates a glob pattern into an anchored regexp. It
+// follows path.Match semantics for `*` and `?`, except that `**` is treated
+// specially and is allowed to match across `/`, unlike a single `*`.
+func wildcardToRegexp(pattern string) (*regexp.Regexp, error) {
+	var out strings.Builder
+	out.WriteString("^")
+
+	for i := 0; i < len(pattern); {
+		switch c := pattern[i]; c {
+		case '*':
+			if i+1 < len(pattern) && pattern[i+1] == '*' {
+				out.WriteString(".*")
+				i += 2
+			} else {
+				out.WriteString("[^/]*")
+				i++
+			}
+		case '?':
+			out.WriteString("[^/]")
+			i++
+		case '[':
+			j := strings.IndexByte(pattern[i:], ']')
+			if j < 0 {
+				out.WriteString(regexp.QuoteMeta(string(c)))
+				i++
+				continue
+			}
+			out.WriteString(pattern[i : i+j+1])
+			i += j + 1
+		default:
+			out.WriteString(regexp.QuoteMeta(string(c)))
+			i++
+		}
+	}
+
+	out.WriteString("$")
+	return regexp.Compile(out.String())
+}
+
 // RenameFile renames (moves) file
 func (publishedStorage *PublishedStorage) RenameFile(oldName, newName string) error {
 	ctx := context.Background()
@@ -235,7 +626,10 @@ func (publishedStorage *PublishedStorage) RenameFile(oldName, newName string) er
 	src := publishedStorage.gcs.Bucket(publishedStorage.bucketName).Object(sourcePath)
 	dst := publishedStorage.gcs.Bucket(publishedStorage.bucketName).Object(destPath)
 
-	if _, err := dst.CopierFrom(src).Run(ctx); err != nil {
+	copier := dst.CopierFrom(src)
+	publishedStorage.configureCopier(copier, newName)
+
+	if _, err := copier.Run(ctx); err != nil {
 		return err
 	}
 	if err := src.Delete(ctx); err != nil {
@@ -252,7 +646,7 @@ func (publishedStorage *PublishedStorage) SymLink(src string, dst string) error
 	sourcePath := filepath.Join(publishedStorage.prefix, src)
 	destPath := filepath.Join(publishedStorage.prefix, dst)
 
-	err := publishedStorage.copy(sourcePath, destPath)
+	err := publishedStorage.copy(sourcePath, destPath, dst)
 	if err != nil {
 		return fmt.Errorf("error symlinking %s -> %s in %s: %s", src, dst, publishedStorage, err)
 	}
@@ -268,13 +662,19 @@ func (publishedStorage *PublishedStorage) SymLink(src string, dst string) error
 	return nil
 }
 
-func (publishedStorage *PublishedStorage) copy(src string, dst string) error {
+// copy copies src to dst, both full object names that already include the
+// storage prefix; relDst is the destination path relative to the prefix,
+// used to pick the right cache-control for the copied object
+func (publishedStorage *PublishedStorage) copy(src string, dst string, relDst string) error {
 	ctx := context.Background()
 
 	srcObj := publishedStorage.gcs.Bucket(publishedStorage.bucketName).Object(src)
 	dstObj := publishedStorage.gcs.Bucket(publishedStorage.bucketName).Object(dst)
 
-	if _, err := dstObj.CopierFrom(srcObj).Run(ctx); err != nil {
+	copier := dstObj.CopierFrom(srcObj)
+	publishedStorage.configureCopier(copier, relDst)
+
+	if _, err := copier.Run(ctx); err != nil {
 		return err
 	}
 
@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/md5"
 	"encoding/base64"
+	"encoding/hex"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -25,9 +26,9 @@ var _ = Suite(&PublishedStorageSuite{})
 func (s *PublishedStorageSuite) SetUpTest(c *C) {
 	s.srv = fakestorage.NewServer([]fakestorage.Object{})
 	s.srv.CreateBucket("test")
-	s.publishedStorage = &PublishedStorage{s.srv.Client(), "test", "", nil}
-	s.prefixedStorage = &PublishedStorage{s.srv.Client(), "test", "lala", nil}
-	s.noSuchBucketStorage = &PublishedStorage{s.srv.Client(), "no-bucket", "", nil}
+	s.publishedStorage = &PublishedStorage{gcs: s.srv.Client(), bucketName: "test", prefix: "", concurrency: defaultConcurrency}
+	s.prefixedStorage = &PublishedStorage{gcs: s.srv.Client(), bucketName: "test", prefix: "lala", concurrency: defaultConcurrency}
+	s.noSuchBucketStorage = &PublishedStorage{gcs: s.srv.Client(), bucketName: "no-bucket", prefix: "", concurrency: defaultConcurrency}
 }
 
 func (s *PublishedStorageSuite) TearDownTest(c *C) {
@@ -80,6 +81,83 @@ func (s *PublishedStorageSuite) TestPutFile(c *C) {
 	c.Check(s.GetFile(c, "lala/a/b.txt"), DeepEquals, []byte("welcome to gcs!"))
 }
 
+func (s *PublishedStorageSuite) TestPutFileObjectConfig(c *C) {
+	s.publishedStorage.indexCacheControl = "public, max-age=3600"
+	s.publishedStorage.poolCacheControl = "public, max-age=31536000, immutable"
+
+	dir := c.MkDir()
+	err := ioutil.WriteFile(filepath.Join(dir, "a"), []byte("contents"), 0644)
+	c.Assert(err, IsNil)
+
+	err = s.publishedStorage.PutFile("dists/stable/Release", filepath.Join(dir, "a"))
+	c.Check(err, IsNil)
+	indexAttrs, err := s.publishedStorage.attrs("dists/stable/Release")
+	c.Check(err, IsNil)
+	c.Check(indexAttrs.CacheControl, Equals, "public, max-age=3600")
+
+	err = s.publishedStorage.PutFile("pool/main/a/aptly/aptly_1.0.deb", filepath.Join(dir, "a"))
+	c.Check(err, IsNil)
+	poolAttrs, err := s.publishedStorage.attrs("pool/main/a/aptly/aptly_1.0.deb")
+	c.Check(err, IsNil)
+	c.Check(poolAttrs.CacheControl, Equals, "public, max-age=31536000, immutable")
+}
+
+func (s *PublishedStorageSuite) TestObjectPreconditionsDefaultUnconditional(c *C) {
+	ctx := context.Background()
+	key := "a/b"
+
+	s.PutFile(c, key, []byte("first"))
+	o := s.publishedStorage.object(ctx, key)
+
+	// a second writer races in and overwrites the object before o is used
+	s.PutFile(c, key, []byte("second"))
+
+	w := o.NewWriter(ctx)
+	_, err := w.Write([]byte("third"))
+	c.Assert(err, IsNil)
+	c.Check(w.Close(), IsNil)
+
+	c.Check(s.GetFile(c, key), DeepEquals, []byte("third"))
+}
+
+func (s *PublishedStorageSuite) TestObjectPreconditionsFirstWrite(c *C) {
+	ctx := context.Background()
+	key := "a/new"
+
+	guarded := &PublishedStorage{gcs: s.srv.Client(), bucketName: "test", forceOverwritePreconditions: true}
+	o := guarded.object(ctx, key)
+
+	// someone else creates the object before our DoesNotExist-guarded write lands
+	s.PutFile(c, key, []byte("raced in"))
+
+	w := o.NewWriter(ctx)
+	_, err := w.Write([]byte("mine"))
+	c.Assert(err, IsNil)
+	c.Check(w.Close(), ErrorMatches, ".*[Pp]recondition.*")
+
+	c.Check(s.GetFile(c, key), DeepEquals, []byte("raced in"))
+}
+
+func (s *PublishedStorageSuite) TestObjectPreconditionsOverwrite(c *C) {
+	ctx := context.Background()
+	key := "a/b"
+
+	guarded := &PublishedStorage{gcs: s.srv.Client(), bucketName: "test", forceOverwritePreconditions: true}
+
+	s.PutFile(c, key, []byte("first"))
+	o := guarded.object(ctx, key)
+
+	// a second writer races in and bumps the generation our precondition was bound to
+	s.PutFile(c, key, []byte("second"))
+
+	w := o.NewWriter(ctx)
+	_, err := w.Write([]byte("third"))
+	c.Assert(err, IsNil)
+	c.Check(w.Close(), ErrorMatches, ".*[Pp]recondition.*")
+
+	c.Check(s.GetFile(c, key), DeepEquals, []byte("second"))
+}
+
 func (s *PublishedStorageSuite) TestFilelist(c *C) {
 	paths := []string{"a", "b", "c", "testa", "test/a", "test/b", "lala/a", "lala/b", "lala/c"}
 	for _, path := range paths {
@@ -139,6 +217,52 @@ func (s *PublishedStorageSuite) TestRemoveDirs(c *C) {
 	c.Check(list, DeepEquals, []string{"a", "b", "c", "lala/a b", "lala/a+b", "lala/c", "testa"})
 }
 
+func (s *PublishedStorageSuite) TestFilelistWildcard(c *C) {
+	paths := []string{
+		"dists/stable/main/binary-amd64/Packages",
+		"dists/stable/main/binary-amd64/Packages.gz",
+		"dists/stable/main/binary-i386/Packages",
+		"dists/unstable/main/binary-amd64/Packages",
+		"dists/stable/contrib/binary-amd64/Packages",
+		"pool/main/a/aptly/aptly_1.0_amd64.deb",
+	}
+	for _, path := range paths {
+		s.PutFile(c, path, []byte("test"))
+	}
+
+	list, err := s.publishedStorage.FilelistWildcard("dists/*/main/binary-*/Packages*")
+	c.Check(err, IsNil)
+	c.Check(list, DeepEquals, []string{
+		"dists/stable/main/binary-amd64/Packages",
+		"dists/stable/main/binary-amd64/Packages.gz",
+		"dists/stable/main/binary-i386/Packages",
+		"dists/unstable/main/binary-amd64/Packages",
+	})
+
+	list, err = s.prefixedStorage.FilelistWildcard("dists/**/Packages")
+	c.Check(err, IsNil)
+	c.Check(list, DeepEquals, []string{})
+}
+
+func (s *PublishedStorageSuite) TestRemoveDirsWildcard(c *C) {
+	paths := []string{
+		"pool/main/l/libav/libav_1.0_amd64.deb",
+		"pool/main/l/libav/libav_1.0_i386.deb",
+		"pool/main/l/libav/libav_2.0_amd64.deb",
+		"pool/main/a/aptly/aptly_1.0_amd64.deb",
+	}
+	for _, path := range paths {
+		s.PutFile(c, path, []byte("test"))
+	}
+
+	err := s.publishedStorage.RemoveDirs("pool/main/*/lib*/*_1.0*.deb", nil)
+	c.Check(err, IsNil)
+
+	list, err := s.publishedStorage.Filelist("")
+	c.Check(err, IsNil)
+	c.Check(list, DeepEquals, []string{"pool/main/a/aptly/aptly_1.0_amd64.deb", "pool/main/l/libav/libav_2.0_amd64.deb"})
+}
+
 func (s *PublishedStorageSuite) TestRemoveDirsNoSuchBucket(c *C) {
 	err := s.noSuchBucketStorage.RemoveDirs("a/b", nil)
 	c.Check(err, IsNil)
@@ -226,6 +350,45 @@ func (s *PublishedStorageSuite) TestLinkFromPool(c *C) {
 	c.Check(s.GetFile(c, "dists/jessie/non-free/installer-i386/current/images/netboot/boot.img.gz"), DeepEquals, []byte("Contents"))
 }
 
+func (s *PublishedStorageSuite) TestPublishBatch(c *C) {
+	root := c.MkDir()
+	pool := files.NewPackagePool(root, false)
+	cs := files.NewMockChecksumStorage()
+
+	names := []string{"aptly_1.0_amd64.deb", "aptly_1.1_amd64.deb", "aptly_1.2_amd64.deb"}
+	entries := make([]PoolEntry, len(names))
+
+	for i, name := range names {
+		tmpFile := filepath.Join(c.MkDir(), name)
+		err := ioutil.WriteFile(tmpFile, []byte(name), 0644)
+		c.Assert(err, IsNil)
+
+		cksum := utils.ChecksumInfo{MD5: md5String(name)}
+		src, err := pool.Import(tmpFile, name, &cksum, true, cs)
+		c.Assert(err, IsNil)
+
+		entries[i] = PoolEntry{
+			PublishedDirectory: filepath.Join("pool", "main", "a", "aptly"),
+			FileName:           name,
+			SourcePath:         src,
+			SourceChecksums:    cksum,
+		}
+	}
+
+	err := s.publishedStorage.PublishBatch(context.Background(), pool, entries, false)
+	c.Check(err, IsNil)
+
+	for _, name := range names {
+		c.Check(s.GetFile(c, filepath.Join("pool", "main", "a", "aptly", name)), DeepEquals, []byte(name))
+	}
+}
+
+func md5String(data string) string {
+	h := md5.New()
+	h.Write([]byte(data))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
 func (s *PublishedStorageSuite) TestSymLink(c *C) {
 	s.PutFile(c, "a/b", []byte("test"))
 